@@ -1,6 +1,8 @@
 package fixture
 
 import (
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -14,9 +16,178 @@ import (
 var log = logf.Log.WithName("fixture")
 var deprovisionRequeueDelay = time.Second * 10
 var provisionRequeueDelay = time.Second * 10
+var servicingRequeueDelay = time.Second * 10
+var powerOffRequeueDelay = time.Second * 10
 
-// Provisioner implements the provisioning.Provisioner interface
-// and uses Ironic to manage the host.
+// maxPowerOffRetryCount is how many stuck soft power-off attempts
+// Delete() tolerates; once PowerOffAttempts exceeds it, Delete() gives
+// up and reports a DeleteError event, mirroring the retry budget the controller's
+// powering-off-before-delete state enforces against Ironic.
+const maxPowerOffRetryCount = 3
+
+// liveISODiskFormat is the Spec.Image.DiskFormat value that selects
+// live-ISO booting instead of writing a disk image.
+const liveISODiskFormat = "live-iso"
+
+// isLiveISO reports whether image describes a live-ISO boot rather
+// than a disk image to be written.
+func isLiveISO(image *metal3v1alpha1.Image) bool {
+	return image.DiskFormat != nil && *image.DiskFormat == liveISODiskFormat
+}
+
+// Fixture holds the simulated state of a host that needs to survive
+// across reconciles. A fixtureProvisioner is recreated by the Factory
+// on every Reconcile, just like the real Ironic provisioner, so
+// anything that needs to persist between calls -- a fake provisioning
+// ID, the simulated power state, how far a multi-step inspection or
+// servicing operation has progressed -- lives here instead of on
+// host.Status. Only the controller is allowed to write host.Status;
+// tests can pre-seed or inspect a Fixture directly to drive and assert
+// on the state machine without going through Status at all.
+type Fixture struct {
+	mu sync.Mutex
+
+	// ProvisioningID is the fake ID assigned once ValidateManagementAccess
+	// has "registered" the host.
+	ProvisioningID string
+
+	// hadError records whether the most recent ValidateManagementAccess
+	// call reported an error, so a later successful call can report
+	// Dirty=true for clearing it -- mirroring host.ClearError()'s
+	// behavior without the provisioner touching host.Status itself.
+	hadError bool
+
+	// HardwareDetails are the simulated inspection results. Set once
+	// inspection completes.
+	HardwareDetails *metal3v1alpha1.HardwareDetails
+
+	// Image is the image the fixture believes is currently written to
+	// the host.
+	Image metal3v1alpha1.Image
+
+	// LiveISO records whether Image is a live-ISO boot rather than a
+	// disk image, so UpdateHardwareState and Deprovision can tell the
+	// two apart.
+	LiveISO bool
+
+	// BootingLiveISO is true for the one reconcile between starting a
+	// live-ISO boot and the fixture reporting LiveISOBooted.
+	BootingLiveISO bool
+
+	// PoweredOn is the simulated power state of the host.
+	PoweredOn bool
+
+	// servicingStep tracks how far a Service() call has progressed.
+	servicingStep int
+
+	// AppliedFirmwareSettings records the settings the fixture last
+	// pretended to apply, so tests can assert against it.
+	AppliedFirmwareSettings map[string]string
+
+	// PowerOffAttempts counts the soft PowerOff() calls that did not
+	// take effect; it is reset to zero when the host powers off. Tests
+	// can pre-seed StuckPowerOffAttempts to make the first N soft
+	// attempts stick without transitioning PoweredOn, simulating a host
+	// that won't shut down cleanly until a forced PowerOff() or until
+	// those N attempts are used up.
+	PowerOffAttempts int
+
+	// StuckPowerOffAttempts is how many soft PowerOff() calls to
+	// simulate as ineffective before honoring them. Zero means every
+	// soft PowerOff() succeeds immediately.
+	StuckPowerOffAttempts int
+
+	// SkipPowerOffOnDelete lets tests bypass the requirement that a
+	// host be powered off before Delete() completes.
+	SkipPowerOffOnDelete bool
+
+	// Faults configures failures to inject into the provisioner
+	// methods below, so controller tests can deterministically drive
+	// the host state machine through error paths without hand-mutating
+	// host.Status.ErrorType.
+	Faults Faults
+}
+
+// Faults controls per-method failure injection on a Fixture. The zero
+// value injects no failures.
+type Faults struct {
+	// ValidateManagementAccessError, if non-empty, makes
+	// ValidateManagementAccess return a Result with this ErrorMessage
+	// instead of registering the host.
+	ValidateManagementAccessError string
+
+	// PreprovisioningImageMissing makes ValidateManagementAccess
+	// return provisioner.ErrNeedsPreprovisioningImage.
+	PreprovisioningImageMissing bool
+
+	// InspectHardwareTransientErrors is how many times InspectHardware
+	// should return a transient error before inspection is allowed to
+	// proceed. Decremented on each call.
+	InspectHardwareTransientErrors int
+
+	// ProvisionRequeues is how many extra times Provision should
+	// report Dirty and requeue before completing. Decremented on each
+	// call.
+	ProvisionRequeues int
+
+	// PowerOnPermanentFail makes PowerOn always return a Result with
+	// an ErrorMessage instead of powering on the host.
+	PowerOnPermanentFail bool
+
+	// DeprovisionSlowSteps is how many extra times Deprovision should
+	// report Dirty without advancing its state machine before
+	// continuing normally. Decremented on each call.
+	DeprovisionSlowSteps int
+}
+
+// Factory implements provisioner.Factory by handing out
+// fixtureProvisioners that share persistent state across reconciles,
+// keyed by host name.
+type Factory struct {
+	mu       sync.Mutex
+	fixtures map[string]*Fixture
+}
+
+// NewFactory returns a Factory with no pre-existing host state.
+func NewFactory() *Factory {
+	return &Factory{
+		fixtures: make(map[string]*Fixture),
+	}
+}
+
+// Fixture returns the persistent state for the named host, creating it
+// if this is the first time the host has been seen. Tests can use the
+// returned Fixture to pre-seed state (force an inspection error,
+// preset PoweredOn=false) before reconciling, and to assert on it
+// afterward.
+func (f *Factory) Fixture(hostName string) *Fixture {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fix, ok := f.fixtures[hostName]
+	if !ok {
+		fix = &Fixture{}
+		f.fixtures[hostName] = fix
+	}
+	return fix
+}
+
+// NewProvisioner returns a new Fixture Provisioner bound to the
+// persistent state for hostData's host.
+func (f *Factory) NewProvisioner(hostData provisioner.HostData, publisher provisioner.EventPublisher) (provisioner.Provisioner, error) {
+	p := &fixtureProvisioner{
+		host:      hostData.Host,
+		bmcCreds:  hostData.BMCCredentials,
+		log:       log.WithValues("host", hostData.Host.Name),
+		publisher: publisher,
+		fixture:   f.Fixture(hostData.Host.Name),
+	}
+	return p, nil
+}
+
+// fixtureProvisioner implements the provisioning.Provisioner interface
+// and simulates the behavior of a real provisioner backend against a
+// Fixture's persistent state instead of a live system.
 type fixtureProvisioner struct {
 	// the host to be managed by this provisioner
 	host *metal3v1alpha1.BareMetalHost
@@ -26,17 +197,8 @@ type fixtureProvisioner struct {
 	log logr.Logger
 	// an event publisher for recording significant events
 	publisher provisioner.EventPublisher
-}
-
-// New returns a new Ironic Provisioner
-func New(host *metal3v1alpha1.BareMetalHost, bmcCreds bmc.Credentials, publisher provisioner.EventPublisher) (provisioner.Provisioner, error) {
-	p := &fixtureProvisioner{
-		host:      host,
-		bmcCreds:  bmcCreds,
-		log:       log.WithValues("host", host.Name),
-		publisher: publisher,
-	}
-	return p, nil
+	// the persistent state shared across reconciles for this host
+	fixture *Fixture
 }
 
 // ValidateManagementAccess tests the connection information for the
@@ -44,19 +206,36 @@ func New(host *metal3v1alpha1.BareMetalHost, bmcCreds bmc.Credentials, publisher
 func (p *fixtureProvisioner) ValidateManagementAccess() (result provisioner.Result, err error) {
 	p.log.Info("testing management access")
 
+	p.fixture.mu.Lock()
+	defer p.fixture.mu.Unlock()
+
+	if p.fixture.Faults.PreprovisioningImageMissing {
+		p.fixture.hadError = true
+		return result, provisioner.ErrNeedsPreprovisioningImage
+	}
+
+	if p.fixture.Faults.ValidateManagementAccessError != "" {
+		p.fixture.hadError = true
+		result.ErrorMessage = p.fixture.Faults.ValidateManagementAccessError
+		return result, nil
+	}
+
 	// Fill in the ID of the host in the provisioning system
-	if p.host.Status.Provisioning.ID == "" {
-		p.host.Status.Provisioning.ID = "temporary-fake-id"
+	if p.fixture.ProvisioningID == "" {
+		p.fixture.ProvisioningID = "temporary-fake-id"
 		p.log.Info("setting provisioning id",
-			"provisioningID", p.host.Status.Provisioning.ID)
+			"provisioningID", p.fixture.ProvisioningID)
 		result.Dirty = true
 		result.RequeueAfter = time.Second * 5
 		p.publisher("Registered", "Registered new host")
 		return result, nil
 	}
 
-	// Clear any error
-	result.Dirty = p.host.ClearError()
+	// Clear any previously reported error.
+	if p.fixture.hadError {
+		p.fixture.hadError = false
+		result.Dirty = true
+	}
 
 	return result, nil
 }
@@ -68,13 +247,21 @@ func (p *fixtureProvisioner) ValidateManagementAccess() (result provisioner.Resu
 func (p *fixtureProvisioner) InspectHardware() (result provisioner.Result, err error) {
 	p.log.Info("inspecting hardware", "status", p.host.OperationalStatus())
 
+	p.fixture.mu.Lock()
+	defer p.fixture.mu.Unlock()
+
+	if p.fixture.Faults.InspectHardwareTransientErrors > 0 {
+		p.fixture.Faults.InspectHardwareTransientErrors--
+		return result, errors.New("transient inspection error")
+	}
+
 	// The inspection is ongoing. We'll need to check the fixture
 	// status for the server here until it is ready for us to get the
 	// inspection details. Simulate that for now by creating the
 	// hardware details struct as part of a second pass.
-	if p.host.Status.HardwareDetails == nil {
+	if p.fixture.HardwareDetails == nil {
 		p.log.Info("continuing inspection by setting details")
-		p.host.Status.HardwareDetails =
+		p.fixture.HardwareDetails =
 			&metal3v1alpha1.HardwareDetails{
 				RAMGiB: 128,
 				NIC: []metal3v1alpha1.NIC{
@@ -131,25 +318,58 @@ func (p *fixtureProvisioner) InspectHardware() (result provisioner.Result, err e
 // information has changed.
 func (p *fixtureProvisioner) UpdateHardwareState() (result provisioner.Result, err error) {
 	if !p.host.NeedsProvisioning() {
-		p.log.Info("updating hardware state")
+		p.fixture.mu.Lock()
+		liveISO := p.fixture.LiveISO
+		p.fixture.mu.Unlock()
+		p.log.Info("updating hardware state", "liveISO", liveISO)
 		result.Dirty = false
 	}
 	return result, nil
 }
 
-// Provision writes the image from the host spec to the host. It may
-// be called multiple times, and should return true for its dirty flag
-// until the deprovisioning operation is completed.
+// Provision writes the image from the host spec to the host, unless
+// the spec calls for booting a live ISO instead, in which case it
+// simulates booting that ISO. It may be called multiple times, and
+// should return true for its dirty flag until the provisioning
+// operation is completed.
 func (p *fixtureProvisioner) Provision(getUserData provisioner.UserDataSource) (result provisioner.Result, err error) {
-	p.log.Info("provisioning image to host",
-		"state", p.host.Status.Provisioning.State)
+	p.log.Info("provisioning image to host")
+
+	p.fixture.mu.Lock()
+	defer p.fixture.mu.Unlock()
+
+	if p.fixture.Faults.ProvisionRequeues > 0 {
+		p.fixture.Faults.ProvisionRequeues--
+		p.log.Info("simulating a slow provision", "remaining", p.fixture.Faults.ProvisionRequeues)
+		result.Dirty = true
+		result.RequeueAfter = provisionRequeueDelay
+		return result, nil
+	}
+
+	liveISO := isLiveISO(p.host.Spec.Image)
+
+	if p.fixture.Image.URL == "" {
+		p.fixture.Image = *p.host.Spec.Image
+		p.fixture.LiveISO = liveISO
+		result.Dirty = true
+		result.RequeueAfter = provisionRequeueDelay
+
+		if liveISO {
+			p.log.Info("booting live ISO")
+			p.fixture.BootingLiveISO = true
+			return result, nil
+		}
 
-	if p.host.Status.Provisioning.Image.URL == "" {
 		p.publisher("ProvisioningComplete", "Image provisioning completed")
 		p.log.Info("moving to done")
-		p.host.Status.Provisioning.Image = *p.host.Spec.Image
+		return result, nil
+	}
+
+	if p.fixture.BootingLiveISO {
+		p.fixture.BootingLiveISO = false
+		p.publisher("LiveISOBooted", "Host booted from live ISO")
 		result.Dirty = true
-		result.RequeueAfter = provisionRequeueDelay
+		return result, nil
 	}
 
 	return result, nil
@@ -163,22 +383,44 @@ func (p *fixtureProvisioner) Deprovision(deleteIt bool) (result provisioner.Resu
 
 	result.RequeueAfter = deprovisionRequeueDelay
 
+	p.fixture.mu.Lock()
+	defer p.fixture.mu.Unlock()
+
 	// NOTE(dhellmann): In order to simulate a multi-step process,
-	// modify some of the status data structures. This is likely not
-	// necessary once we really have Fixture doing the deprovisioning
-	// and we can monitor it's status.
+	// advance the fixture's state machine one step at a time. This is
+	// likely not necessary once we really have Fixture doing the
+	// deprovisioning and we can monitor its status.
 
-	if p.host.Status.HardwareDetails != nil {
+	if p.fixture.Faults.DeprovisionSlowSteps > 0 {
+		p.fixture.Faults.DeprovisionSlowSteps--
+		p.log.Info("simulating a slow deprovision step", "remaining", p.fixture.Faults.DeprovisionSlowSteps)
+		result.Dirty = true
+		return result, nil
+	}
+
+	if p.fixture.HardwareDetails != nil {
 		p.publisher("DeprovisionStarted", "Image deprovisioning started")
 		p.log.Info("clearing hardware details")
-		p.host.Status.HardwareDetails = nil
+		p.fixture.HardwareDetails = nil
 		result.Dirty = true
 		return result, nil
 	}
 
-	if p.host.Status.Provisioning.ID != "" {
+	if p.fixture.ProvisioningID != "" {
 		p.log.Info("clearing provisioning id")
-		p.host.Status.Provisioning.ID = ""
+		p.fixture.ProvisioningID = ""
+		result.Dirty = true
+		return result, nil
+	}
+
+	if p.fixture.LiveISO {
+		// There is no written image to clean up when the host booted
+		// from a live ISO, but we still need to power-cycle it to
+		// drop out of the ISO session.
+		p.log.Info("power-cycling host booted from live ISO")
+		p.fixture.LiveISO = false
+		p.fixture.BootingLiveISO = false
+		p.fixture.PoweredOn = false
 		result.Dirty = true
 		return result, nil
 	}
@@ -192,10 +434,18 @@ func (p *fixtureProvisioner) Deprovision(deleteIt bool) (result provisioner.Resu
 func (p *fixtureProvisioner) PowerOn() (result provisioner.Result, err error) {
 	p.log.Info("ensuring host is powered on")
 
-	if !p.host.Status.PoweredOn {
+	p.fixture.mu.Lock()
+	defer p.fixture.mu.Unlock()
+
+	if p.fixture.Faults.PowerOnPermanentFail {
+		result.ErrorMessage = "power on permanently failed"
+		return result, nil
+	}
+
+	if !p.fixture.PoweredOn {
 		p.publisher("PowerOn", "Host powered on")
 		p.log.Info("changing status")
-		p.host.Status.PoweredOn = true
+		p.fixture.PoweredOn = true
 		result.Dirty = true
 		return result, nil
 	}
@@ -204,17 +454,135 @@ func (p *fixtureProvisioner) PowerOn() (result provisioner.Result, err error) {
 }
 
 // PowerOff ensures the server is powered off independently of any image
-// provisioning operation.
-func (p *fixtureProvisioner) PowerOff() (result provisioner.Result, err error) {
-	p.log.Info("ensuring host is powered off")
+// provisioning operation. A soft power off (force=false) may need to
+// be attempted more than once before it takes effect; force=true
+// always succeeds immediately, simulating a hard power cut.
+func (p *fixtureProvisioner) PowerOff(force bool) (result provisioner.Result, err error) {
+	p.log.Info("ensuring host is powered off", "force", force)
 
-	if p.host.Status.PoweredOn {
-		p.publisher("PowerOff", "Host powered off")
-		p.log.Info("changing status")
-		p.host.Status.PoweredOn = false
+	p.fixture.mu.Lock()
+	defer p.fixture.mu.Unlock()
+
+	if !p.fixture.PoweredOn {
+		return result, nil
+	}
+
+	if !force && p.fixture.PowerOffAttempts < p.fixture.StuckPowerOffAttempts {
+		p.fixture.PowerOffAttempts++
+		p.log.Info("soft power off did not take effect",
+			"attempt", p.fixture.PowerOffAttempts)
 		result.Dirty = true
+		result.RequeueAfter = powerOffRequeueDelay
 		return result, nil
 	}
 
+	p.publisher("PowerOff", "Host powered off")
+	p.log.Info("changing status")
+	p.fixture.PoweredOn = false
+	p.fixture.PowerOffAttempts = 0
+	result.Dirty = true
 	return result, nil
 }
+
+// Delete removes the host from the fixture entirely, distinct from
+// Deprovision(deleteIt) which only clears provisioning state. The
+// host must be powered off first unless SkipPowerOffOnDelete is set;
+// while it isn't, Delete() keeps requeuing and driving PowerOff(false)
+// itself, giving up and reporting a DeleteError once the retry budget
+// in maxPowerOffRetryCount is exceeded.
+func (p *fixtureProvisioner) Delete() (result provisioner.Result, err error) {
+	p.log.Info("deleting host")
+
+	p.fixture.mu.Lock()
+	poweredOn := p.fixture.PoweredOn
+	skipPowerOff := p.fixture.SkipPowerOffOnDelete
+	p.fixture.mu.Unlock()
+
+	if poweredOn && !skipPowerOff {
+		powerResult, err := p.PowerOff(false)
+		if err != nil {
+			return result, err
+		}
+
+		p.fixture.mu.Lock()
+		attempts := p.fixture.PowerOffAttempts
+		p.fixture.mu.Unlock()
+
+		if attempts > maxPowerOffRetryCount {
+			p.publisher("DeleteError", "Timed out waiting for host to power off")
+			result.ErrorMessage = "timed out waiting for host to power off before delete"
+			return result, nil
+		}
+
+		result.Dirty = true
+		result.RequeueAfter = powerResult.RequeueAfter
+		return result, nil
+	}
+
+	p.publisher("DeleteComplete", "Host removed")
+	return result, nil
+}
+
+// Service updates the host firmware settings and components to match
+// the desired state described by data. It may be called multiple
+// times, and should return true for its dirty flag until the
+// servicing operation is completed. started is true only for the call
+// that kicks off the operation, matching the day-2 servicing state
+// machine the controller drives for firmware/component updates.
+func (p *fixtureProvisioner) Service(data provisioner.ServicingData, restartOnFailure, forceReboot bool) (result provisioner.Result, started bool, err error) {
+	p.log.Info("servicing host")
+
+	p.fixture.mu.Lock()
+	defer p.fixture.mu.Unlock()
+
+	if !needsServicing(data) {
+		p.fixture.servicingStep = 0
+		return result, false, nil
+	}
+
+	switch p.fixture.servicingStep {
+	case 0:
+		p.log.Info("starting servicing")
+		p.fixture.servicingStep = 1
+		result.Dirty = true
+		result.RequeueAfter = servicingRequeueDelay
+		return result, true, nil
+
+	case 1:
+		p.log.Info("servicing in progress")
+		p.fixture.servicingStep = 2
+		p.fixture.AppliedFirmwareSettings = data.TargetFirmwareSettings
+		result.Dirty = true
+		result.RequeueAfter = servicingRequeueDelay
+		return result, false, nil
+
+	default:
+		p.publisher("ServicingComplete", "Servicing completed")
+		p.fixture.servicingStep = 0
+		return result, false, nil
+	}
+}
+
+// needsServicing reports whether the actual firmware settings or
+// components differ from the target, meaning a Service() call has
+// something to do.
+func needsServicing(data provisioner.ServicingData) bool {
+	return !settingsEqual(data.ActualFirmwareSettings, data.TargetFirmwareSettings) ||
+		!settingsEqual(data.ActualFirmwareComponents, data.TargetFirmwareComponents)
+}
+
+// settingsEqual compares two firmware settings/components maps,
+// treating nil and empty as equivalent so that callers who leave an
+// "actual" map unset don't spuriously look different from a caller
+// who set it to an empty map.
+func settingsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,444 @@
+package fixture
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	metal3v1alpha1 "github.com/metal3-io/baremetal-operator/pkg/apis/metal3/v1alpha1"
+	"github.com/metal3-io/baremetal-operator/pkg/bmc"
+	"github.com/metal3-io/baremetal-operator/pkg/provisioner"
+)
+
+func newTestHost(name string) *metal3v1alpha1.BareMetalHost {
+	return &metal3v1alpha1.BareMetalHost{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+	}
+}
+
+// newTestProvisioner returns a Factory-backed provisioner for host,
+// along with the Factory (so the test can reach into the host's
+// Fixture) and a slice that accumulates the reasons of every event
+// the provisioner publishes.
+func newTestProvisioner(t *testing.T, host *metal3v1alpha1.BareMetalHost) (*Factory, provisioner.Provisioner, *[]string) {
+	t.Helper()
+
+	factory := NewFactory()
+	events := &[]string{}
+	publisher := func(reason, message string) {
+		*events = append(*events, reason)
+	}
+
+	p, err := factory.NewProvisioner(provisioner.HostData{
+		Host:           host,
+		BMCCredentials: bmc.Credentials{},
+	}, publisher)
+	if err != nil {
+		t.Fatalf("NewProvisioner() error = %v", err)
+	}
+
+	return factory, p, events
+}
+
+func hasEvent(events []string, reason string) bool {
+	for _, e := range events {
+		if e == reason {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNeedsServicingNormalizesNilAndEmpty(t *testing.T) {
+	cases := []struct {
+		name string
+		data provisioner.ServicingData
+		want bool
+	}{
+		{
+			name: "nil actual, empty target",
+			data: provisioner.ServicingData{
+				ActualFirmwareSettings: nil,
+				TargetFirmwareSettings: map[string]string{},
+			},
+			want: false,
+		},
+		{
+			name: "nil actual, non-empty target",
+			data: provisioner.ServicingData{
+				ActualFirmwareSettings: nil,
+				TargetFirmwareSettings: map[string]string{"BootMode": "UEFI"},
+			},
+			want: true,
+		},
+		{
+			name: "matching components, nil vs empty",
+			data: provisioner.ServicingData{
+				ActualFirmwareComponents: map[string]string{},
+				TargetFirmwareComponents: nil,
+			},
+			want: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := needsServicing(tc.data); got != tc.want {
+				t.Errorf("needsServicing() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestServiceLifecycle(t *testing.T) {
+	host := newTestHost("host-service")
+	factory, p, events := newTestProvisioner(t, host)
+
+	data := provisioner.ServicingData{
+		ActualFirmwareSettings: map[string]string{"BootMode": "Legacy"},
+		TargetFirmwareSettings: map[string]string{"BootMode": "UEFI"},
+	}
+
+	result, started, err := p.Service(data, false, false)
+	if err != nil {
+		t.Fatalf("first Service() error = %v", err)
+	}
+	if !started {
+		t.Errorf("expected started=true on first call")
+	}
+	if !result.Dirty {
+		t.Errorf("expected Dirty=true on first call")
+	}
+
+	result, started, err = p.Service(data, false, false)
+	if err != nil {
+		t.Fatalf("second Service() error = %v", err)
+	}
+	if started {
+		t.Errorf("expected started=false on second call")
+	}
+	if !result.Dirty {
+		t.Errorf("expected Dirty=true while servicing is in progress")
+	}
+
+	fix := factory.Fixture(host.Name)
+	if got := fix.AppliedFirmwareSettings["BootMode"]; got != "UEFI" {
+		t.Errorf("AppliedFirmwareSettings[BootMode] = %q, want %q", got, "UEFI")
+	}
+
+	result, started, err = p.Service(data, false, false)
+	if err != nil {
+		t.Fatalf("third Service() error = %v", err)
+	}
+	if started {
+		t.Errorf("expected started=false on completion call")
+	}
+	if result.Dirty {
+		t.Errorf("expected Dirty=false once servicing completes")
+	}
+	if !hasEvent(*events, "ServicingComplete") {
+		t.Errorf("expected a ServicingComplete event, got %v", *events)
+	}
+}
+
+func TestPowerOffForceOverridesStuckAttempts(t *testing.T) {
+	host := newTestHost("host-poweroff")
+	factory, p, events := newTestProvisioner(t, host)
+
+	fix := factory.Fixture(host.Name)
+	fix.PoweredOn = true
+	fix.StuckPowerOffAttempts = 2
+
+	for i := 0; i < fix.StuckPowerOffAttempts; i++ {
+		result, err := p.PowerOff(false)
+		if err != nil {
+			t.Fatalf("PowerOff(false) error = %v", err)
+		}
+		if !result.Dirty {
+			t.Errorf("attempt %d: expected Dirty=true while the soft power off is stuck", i)
+		}
+		if !fix.PoweredOn {
+			t.Errorf("attempt %d: PoweredOn should not change while the soft power off is stuck", i)
+		}
+	}
+
+	result, err := p.PowerOff(true)
+	if err != nil {
+		t.Fatalf("PowerOff(true) error = %v", err)
+	}
+	if !result.Dirty {
+		t.Errorf("expected Dirty=true when a forced power off takes effect")
+	}
+	if fix.PoweredOn {
+		t.Errorf("expected PoweredOn=false after a forced power off")
+	}
+	if !hasEvent(*events, "PowerOff") {
+		t.Errorf("expected a PowerOff event, got %v", *events)
+	}
+}
+
+func TestDeletePowerOffRetryExhaustion(t *testing.T) {
+	host := newTestHost("host-delete")
+	factory, p, events := newTestProvisioner(t, host)
+
+	fix := factory.Fixture(host.Name)
+	fix.PoweredOn = true
+	fix.StuckPowerOffAttempts = maxPowerOffRetryCount + 5
+
+	for i := 0; i < maxPowerOffRetryCount; i++ {
+		result, err := p.Delete()
+		if err != nil {
+			t.Fatalf("Delete() error at attempt %d = %v", i, err)
+		}
+		if result.ErrorMessage != "" {
+			t.Fatalf("Delete() reported an error too early at attempt %d: %q", i, result.ErrorMessage)
+		}
+	}
+
+	result, err := p.Delete()
+	if err != nil {
+		t.Fatalf("final Delete() error = %v", err)
+	}
+	if result.ErrorMessage == "" {
+		t.Errorf("expected Delete() to give up once the retry budget is exceeded")
+	}
+	if !hasEvent(*events, "DeleteError") {
+		t.Errorf("expected a DeleteError event, got %v", *events)
+	}
+}
+
+func TestDeleteSkipsPowerOffWhenConfigured(t *testing.T) {
+	host := newTestHost("host-delete-skip")
+	factory, p, events := newTestProvisioner(t, host)
+
+	fix := factory.Fixture(host.Name)
+	fix.PoweredOn = true
+	fix.SkipPowerOffOnDelete = true
+
+	result, err := p.Delete()
+	if err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if result.ErrorMessage != "" {
+		t.Errorf("unexpected ErrorMessage: %q", result.ErrorMessage)
+	}
+	if !hasEvent(*events, "DeleteComplete") {
+		t.Errorf("expected a DeleteComplete event, got %v", *events)
+	}
+}
+
+func TestProvisionAndDeprovisionLiveISO(t *testing.T) {
+	diskFormat := liveISODiskFormat
+	host := newTestHost("host-live-iso")
+	host.Spec.Image = &metal3v1alpha1.Image{
+		URL:        "http://example.com/boot.iso",
+		DiskFormat: &diskFormat,
+	}
+
+	factory, p, events := newTestProvisioner(t, host)
+	fix := factory.Fixture(host.Name)
+
+	result, err := p.Provision(nil)
+	if err != nil {
+		t.Fatalf("first Provision() error = %v", err)
+	}
+	if !result.Dirty {
+		t.Errorf("expected Dirty=true while the ISO starts booting")
+	}
+	if !fix.LiveISO {
+		t.Errorf("expected the fixture to record LiveISO=true")
+	}
+	if !fix.BootingLiveISO {
+		t.Errorf("expected BootingLiveISO=true after the first Provision() call")
+	}
+
+	result, err = p.Provision(nil)
+	if err != nil {
+		t.Fatalf("second Provision() error = %v", err)
+	}
+	if !result.Dirty {
+		t.Errorf("expected Dirty=true on the call that reports the ISO booted")
+	}
+	if fix.BootingLiveISO {
+		t.Errorf("expected BootingLiveISO=false once the ISO has booted")
+	}
+	if !hasEvent(*events, "LiveISOBooted") {
+		t.Errorf("expected a LiveISOBooted event, got %v", *events)
+	}
+
+	result, err = p.Provision(nil)
+	if err != nil {
+		t.Fatalf("third Provision() error = %v", err)
+	}
+	if result.Dirty {
+		t.Errorf("expected Dirty=false once the live-ISO boot is complete")
+	}
+
+	fix.PoweredOn = true
+
+	result, err = p.Deprovision(false)
+	if err != nil {
+		t.Fatalf("first Deprovision() error = %v", err)
+	}
+	if !result.Dirty {
+		t.Errorf("expected Dirty=true while the host power-cycles out of the ISO")
+	}
+	if fix.LiveISO {
+		t.Errorf("expected LiveISO=false after the power cycle step")
+	}
+	if fix.PoweredOn {
+		t.Errorf("expected the host to be powered off as part of deprovisioning a live-ISO boot")
+	}
+
+	result, err = p.Deprovision(false)
+	if err != nil {
+		t.Fatalf("second Deprovision() error = %v", err)
+	}
+	if result.Dirty {
+		t.Errorf("expected Dirty=false once deprovisioning completes")
+	}
+	if !hasEvent(*events, "DeprovisionComplete") {
+		t.Errorf("expected a DeprovisionComplete event, got %v", *events)
+	}
+}
+
+func TestFaultsPreprovisioningImageMissing(t *testing.T) {
+	host := newTestHost("host-faults-preprov")
+	factory, p, _ := newTestProvisioner(t, host)
+	factory.Fixture(host.Name).Faults.PreprovisioningImageMissing = true
+
+	_, err := p.ValidateManagementAccess()
+	if err != provisioner.ErrNeedsPreprovisioningImage {
+		t.Errorf("ValidateManagementAccess() error = %v, want %v", err, provisioner.ErrNeedsPreprovisioningImage)
+	}
+}
+
+func TestValidateManagementAccessClearsPreviousError(t *testing.T) {
+	host := newTestHost("host-clear-error")
+	factory, p, _ := newTestProvisioner(t, host)
+	fix := factory.Fixture(host.Name)
+	// Pre-register the host so the second call exercises the
+	// clear-error path rather than the registration path.
+	fix.ProvisioningID = "temporary-fake-id"
+	fix.Faults.ValidateManagementAccessError = "bmc unreachable"
+
+	result, err := p.ValidateManagementAccess()
+	if err != nil {
+		t.Fatalf("ValidateManagementAccess() error = %v", err)
+	}
+	if result.ErrorMessage == "" {
+		t.Errorf("expected ErrorMessage to be set while the fault is active")
+	}
+
+	fix.Faults.ValidateManagementAccessError = ""
+
+	result, err = p.ValidateManagementAccess()
+	if err != nil {
+		t.Fatalf("second ValidateManagementAccess() error = %v", err)
+	}
+	if result.ErrorMessage != "" {
+		t.Errorf("unexpected ErrorMessage: %q", result.ErrorMessage)
+	}
+	if !result.Dirty {
+		t.Errorf("expected Dirty=true so the host can clear its previously reported error")
+	}
+}
+
+func TestFaultsInspectHardwareTransientErrors(t *testing.T) {
+	host := newTestHost("host-faults-inspect")
+	factory, p, _ := newTestProvisioner(t, host)
+	fix := factory.Fixture(host.Name)
+	fix.Faults.InspectHardwareTransientErrors = 2
+
+	for i := 0; i < 2; i++ {
+		if _, err := p.InspectHardware(); err == nil {
+			t.Errorf("attempt %d: expected a transient error", i)
+		}
+	}
+
+	result, err := p.InspectHardware()
+	if err != nil {
+		t.Fatalf("InspectHardware() error = %v", err)
+	}
+	if !result.Dirty {
+		t.Errorf("expected inspection to proceed once the transient errors are exhausted")
+	}
+	if fix.HardwareDetails == nil {
+		t.Errorf("expected HardwareDetails to be populated")
+	}
+}
+
+func TestFaultsProvisionRequeues(t *testing.T) {
+	host := newTestHost("host-faults-provision")
+	host.Spec.Image = &metal3v1alpha1.Image{URL: "http://example.com/image.qcow2"}
+	factory, p, _ := newTestProvisioner(t, host)
+	fix := factory.Fixture(host.Name)
+	fix.Faults.ProvisionRequeues = 2
+
+	for i := 0; i < 2; i++ {
+		result, err := p.Provision(nil)
+		if err != nil {
+			t.Fatalf("attempt %d: Provision() error = %v", i, err)
+		}
+		if !result.Dirty {
+			t.Errorf("attempt %d: expected Dirty=true for the injected requeue", i)
+		}
+		if fix.Image.URL != "" {
+			t.Errorf("attempt %d: provisioning should not have progressed yet", i)
+		}
+	}
+
+	result, err := p.Provision(nil)
+	if err != nil {
+		t.Fatalf("final Provision() error = %v", err)
+	}
+	if !result.Dirty {
+		t.Errorf("expected Dirty=true for the call that completes provisioning")
+	}
+	if fix.Image.URL == "" {
+		t.Errorf("expected provisioning to progress once the injected requeues are exhausted")
+	}
+}
+
+func TestFaultsPowerOnPermanentFail(t *testing.T) {
+	host := newTestHost("host-faults-poweron")
+	factory, p, _ := newTestProvisioner(t, host)
+	factory.Fixture(host.Name).Faults.PowerOnPermanentFail = true
+
+	result, err := p.PowerOn()
+	if err != nil {
+		t.Fatalf("PowerOn() error = %v", err)
+	}
+	if result.ErrorMessage == "" {
+		t.Errorf("expected an ErrorMessage when PowerOnPermanentFail is set")
+	}
+	if factory.Fixture(host.Name).PoweredOn {
+		t.Errorf("expected PoweredOn to remain false")
+	}
+}
+
+func TestFaultsDeprovisionSlowSteps(t *testing.T) {
+	host := newTestHost("host-faults-deprovision")
+	factory, p, _ := newTestProvisioner(t, host)
+	fix := factory.Fixture(host.Name)
+	fix.Faults.DeprovisionSlowSteps = 1
+
+	result, err := p.Deprovision(false)
+	if err != nil {
+		t.Fatalf("Deprovision() error = %v", err)
+	}
+	if !result.Dirty {
+		t.Errorf("expected Dirty=true for the injected slow step")
+	}
+	if fix.Faults.DeprovisionSlowSteps != 0 {
+		t.Errorf("expected DeprovisionSlowSteps to be decremented")
+	}
+
+	result, err = p.Deprovision(false)
+	if err != nil {
+		t.Fatalf("second Deprovision() error = %v", err)
+	}
+	if result.Dirty {
+		t.Errorf("expected Dirty=false once the slow step is consumed and there is nothing left to clean up")
+	}
+}